@@ -1,27 +1,88 @@
 package csrf
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
-	"errors"
 	"io"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 const (
-	csrfSecret = "csrfSecret"
-	csrfSalt   = "csrfSalt"
-	csrfToken  = "csrfToken"
+	csrfSecret  = "csrfSecret"
+	csrfSalt    = "csrfSalt"
+	csrfToken   = "csrfToken"
+	csrfFailure = "csrf_failure"
 )
 
 var defaultIgnoreMethods = []string{"GET", "HEAD", "OPTIONS"}
 
+// Reason identifies why a CSRF check rejected a request.
+type Reason int
+
+const (
+	ReasonBadToken Reason = iota
+	ReasonMissingToken
+	ReasonBadOrigin
+	ReasonExpiredToken
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonMissingToken:
+		return "csrf: missing token"
+	case ReasonBadOrigin:
+		return "csrf: bad origin"
+	case ReasonExpiredToken:
+		return "csrf: token expired"
+	default:
+		return "csrf: bad token"
+	}
+}
+
+// Error is the failure recorded by Middleware and MiddlewareCookie, and
+// returned by FailureReason. Err, when set, wraps the underlying cause.
+type Error struct {
+	Reason Reason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Reason.String() + ": " + e.Err.Error()
+	}
+
+	return e.Reason.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// defaultErrorFunc writes a 403 with a short message describing the
+// FailureReason, instead of panicking. Gin apps that don't install a
+// recovery middleware capable of translating panics into HTTP responses
+// need this to fail safely.
 var defaultErrorFunc = func(c *gin.Context) {
-	panic(errors.New("CSRF token mismatch"))
+	msg := ReasonBadToken.String()
+	if err := FailureReason(c); err != nil {
+		msg = err.Error()
+	}
+
+	c.Abort()
+	c.String(http.StatusForbidden, msg)
 }
 
 var defaultTokenGetter = func(c *gin.Context) string {
@@ -48,6 +109,79 @@ type Options struct {
 	IgnorePaths   []string
 	ErrorFunc     gin.HandlerFunc
 	TokenGetter   func(c *gin.Context) string
+
+	// TokenLookup is a comma-separated list of "source:name" pairs describing
+	// where to read the submitted token from, e.g.
+	// "header:X-CSRF-Token,form:_csrf,query:_csrf,cookie:_csrf,json:csrf_token".
+	// Supported sources are header, form, query, cookie and json. Sources are
+	// tried in order and the first non-empty value wins. When set, it takes
+	// precedence over TokenGetter.
+	TokenLookup string
+
+	// CookieName and friends configure the cookie issued by MiddlewareCookie.
+	// They are unused by Middleware, which relies on gin-contrib/sessions instead.
+	CookieName     string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieHTTPOnly bool
+	CookieSameSite http.SameSite
+	CookieExpires  time.Duration
+
+	// CookieBind, when set, returns a value (e.g. a user or session ID) that is
+	// bound into the signed cookie token so it cannot be replayed across accounts.
+	CookieBind func(c *gin.Context) string
+
+	// CheckOrigin verifies the Origin (falling back to Referer) header of
+	// unsafe requests against the request host plus TrustedOrigins before
+	// token comparison runs. TrustedOrigins lists additional "host[:port]"
+	// values to accept, e.g. a trusted subdomain.
+	CheckOrigin    bool
+	TrustedOrigins []string
+
+	// SameOriginOnly is a shortcut for CheckOrigin that rejects every
+	// cross-origin request outright, ignoring TrustedOrigins.
+	SameOriginOnly bool
+
+	// TokenLifetime, when greater than zero, expires a session's salt after
+	// it has been outstanding this long; Middleware rejects the request and
+	// rotates the salt so the next GetToken call issues a fresh one.
+	TokenLifetime time.Duration
+
+	// RotateOnUse, when true, rotates the session's salt after every
+	// successful validation of an unsafe-method request, so each
+	// state-changing request consumes a fresh token.
+	RotateOnUse bool
+}
+
+// storeSalt generates a new salt, persists it in the session alongside its
+// creation time (as "salt|unixtime"), and returns the salt.
+func storeSalt(session sessions.Session) string {
+	salt := uniuri.New()
+	session.Set(csrfSalt, salt+"|"+strconv.FormatInt(time.Now().Unix(), 10))
+	session.Save()
+
+	return salt
+}
+
+// loadSalt reads the salt and its creation time persisted by storeSalt.
+func loadSalt(session sessions.Session) (salt string, created time.Time, ok bool) {
+	record, ok := session.Get(csrfSalt).(string)
+	if !ok || len(record) == 0 {
+		return "", time.Time{}, false
+	}
+
+	parts := strings.SplitN(record, "|", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+
+	sec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return parts[0], time.Unix(sec, 0), true
 }
 
 func tokenize(secret, salt string) string {
@@ -58,6 +192,87 @@ func tokenize(secret, salt string) string {
 	return hash
 }
 
+// jsonBodyField reads field out of a JSON request body. It uses
+// ShouldBindBodyWith so the body is cached on the context and remains
+// readable by subsequent binds in downstream handlers.
+func jsonBodyField(c *gin.Context, field string) string {
+	var body map[string]interface{}
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		return ""
+	}
+
+	v, _ := body[field].(string)
+
+	return v
+}
+
+// parseTokenLookup parses a TokenLookup DSL string into an ordered slice of
+// extractor functions, one per "source:name" entry. Unknown or malformed
+// entries are skipped.
+func parseTokenLookup(lookup string) []func(c *gin.Context) string {
+	var extractors []func(c *gin.Context) string
+
+	for _, entry := range strings.Split(lookup, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		source, name := parts[0], parts[1]
+
+		switch source {
+		case "header":
+			extractors = append(extractors, func(c *gin.Context) string {
+				return c.GetHeader(name)
+			})
+		case "form":
+			extractors = append(extractors, func(c *gin.Context) string {
+				return c.Request.FormValue(name)
+			})
+		case "query":
+			extractors = append(extractors, func(c *gin.Context) string {
+				return c.Query(name)
+			})
+		case "cookie":
+			extractors = append(extractors, func(c *gin.Context) string {
+				v, _ := c.Cookie(name)
+				return v
+			})
+		case "json":
+			extractors = append(extractors, func(c *gin.Context) string {
+				return jsonBodyField(c, name)
+			})
+		}
+	}
+
+	return extractors
+}
+
+// buildTokenGetter resolves the token extraction function for options,
+// preferring TokenLookup over TokenGetter, and falling back to
+// defaultTokenGetter when neither is set.
+func buildTokenGetter(options Options) func(c *gin.Context) string {
+	if options.TokenLookup != "" {
+		extractors := parseTokenLookup(options.TokenLookup)
+
+		return func(c *gin.Context) string {
+			for _, extract := range extractors {
+				if t := extract(c); len(t) > 0 {
+					return t
+				}
+			}
+
+			return ""
+		}
+	}
+
+	if options.TokenGetter != nil {
+		return options.TokenGetter
+	}
+
+	return defaultTokenGetter
+}
+
 func inArray(arr []string, value string) bool {
 	inarr := false
 
@@ -71,11 +286,59 @@ func inArray(arr []string, value string) bool {
 	return inarr
 }
 
+// verifyOrigin checks the Origin header (falling back to Referer) of an
+// unsafe request against the request host and options.TrustedOrigins.
+func verifyOrigin(c *gin.Context, options Options) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		origin = c.GetHeader("Referer")
+	}
+
+	if origin == "" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if u.Host == c.Request.Host {
+		return true
+	}
+
+	if options.SameOriginOnly {
+		return false
+	}
+
+	return inArray(options.TrustedOrigins, u.Host)
+}
+
+// setFailure records the reason a request was rejected so it can be
+// retrieved later via FailureReason.
+func setFailure(c *gin.Context, err error) {
+	c.Set(csrfFailure, err)
+}
+
+// FailureReason returns the error recorded by Middleware or MiddlewareCookie
+// when they reject a request, or nil if the request was not rejected or no
+// reason was recorded.
+func FailureReason(c *gin.Context) error {
+	v, ok := c.Get(csrfFailure)
+	if !ok {
+		return nil
+	}
+
+	err, _ := v.(error)
+
+	return err
+}
+
 // Middleware validates CSRF token.
 func Middleware(options Options) gin.HandlerFunc {
 	ignoreMethods := options.IgnoreMethods
 	errorFunc := options.ErrorFunc
-	tokenGetter := options.TokenGetter
+	tokenGetter := buildTokenGetter(options)
 
 	if ignoreMethods == nil {
 		ignoreMethods = defaultIgnoreMethods
@@ -85,10 +348,6 @@ func Middleware(options Options) gin.HandlerFunc {
 		errorFunc = defaultErrorFunc
 	}
 
-	if tokenGetter == nil {
-		tokenGetter = defaultTokenGetter
-	}
-
 	return func(c *gin.Context) {
 		session := sessions.Default(c)
 		c.Set(csrfSecret, options.Secret)
@@ -106,60 +365,281 @@ func Middleware(options Options) gin.HandlerFunc {
 			c.Next()
 			return
 		}
-		salt, ok := session.Get(csrfSalt).(string)
+
+		if options.CheckOrigin || options.SameOriginOnly {
+			if !verifyOrigin(c, options) {
+				setFailure(c, &Error{Reason: ReasonBadOrigin})
+				errorFunc(c)
+				return
+			}
+		}
+
+		salt, created, ok := loadSalt(session)
 
 		if !ok || len(salt) == 0 {
+			setFailure(c, &Error{Reason: ReasonMissingToken})
+			errorFunc(c)
+			return
+		}
+
+		if options.TokenLifetime > 0 && time.Since(created) > options.TokenLifetime {
+			storeSalt(session)
+			setFailure(c, &Error{Reason: ReasonExpiredToken})
 			errorFunc(c)
 			return
 		}
 
 		token := tokenGetter(c)
 
-		if tokenize(options.Secret, salt) != token {
+		real, ok := unmaskToken(token)
+		if !ok {
+			setFailure(c, &Error{Reason: ReasonBadToken})
+			errorFunc(c)
+			return
+		}
+
+		expected := sha256.Sum256([]byte(tokenize(options.Secret, salt)))
+		if subtle.ConstantTimeCompare(real, expected[:]) != 1 {
+			setFailure(c, &Error{Reason: ReasonBadToken})
 			errorFunc(c)
 			return
 		}
 
+		if options.RotateOnUse {
+			RefreshToken(c)
+		}
+
 		c.Next()
 	}
 }
 
-// GetToken returns a CSRF token.
-func GetToken(c *gin.Context) string {
-	session := sessions.Default(c)
-	secret := c.MustGet(csrfSecret).(string)
-
+// getRawToken returns the stable, unmasked CSRF token for the session,
+// generating and persisting a salt on first use.
+func getRawToken(c *gin.Context) string {
 	if t, ok := c.Get(csrfToken); ok {
 		return t.(string)
 	}
 
-	salt, ok := session.Get(csrfSalt).(string)
+	session := sessions.Default(c)
+	secret := c.MustGet(csrfSecret).(string)
+
+	salt, _, ok := loadSalt(session)
 	if !ok {
-		salt = uniuri.New()
-		session.Set(csrfSalt, salt)
-		session.Save()
+		salt = storeSalt(session)
 	}
+
 	token := tokenize(secret, salt)
 	c.Set(csrfToken, token)
 
 	return token
 }
 
-// RefreshToken returns a CSRF token.
+// GetToken returns a masked CSRF token suitable for embedding in a form or
+// response body under session-based Middleware. Each call returns a freshly
+// masked ciphertext of the same underlying token, so responses never leak a
+// stable value an attacker could recover via a compression oracle (BREACH).
+// See MaskedToken. Under MiddlewareCookie, use CookieToken instead: the
+// double-submit comparison there is a literal compare against the cookie
+// value, which a masked ciphertext can never match.
+func GetToken(c *gin.Context) string {
+	return maskToken(getRawToken(c))
+}
+
+// MaskedToken is an explicit alias for GetToken, named to make the BREACH
+// mitigation obvious at call sites.
+func MaskedToken(c *gin.Context) string {
+	return GetToken(c)
+}
+
+// CookieToken returns the raw double-submit token issued by MiddlewareCookie,
+// for embedding in a form field, header, or other location read back by
+// TokenGetter/TokenLookup. It is not masked, since MiddlewareCookie validates
+// it with a direct constant-time compare against the cookie value.
+func CookieToken(c *gin.Context) string {
+	t, _ := c.Get(csrfToken)
+	token, _ := t.(string)
+
+	return token
+}
+
+const maskLen = 32
+
+// maskToken XORs a fresh random pad over the SHA-256 digest of token and
+// returns base64(pad || masked). Decoded and XORed back together by
+// unmaskToken, this recovers the digest without ever repeating ciphertext.
+func maskToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+
+	pad := make([]byte, maskLen)
+	if _, err := rand.Read(pad); err != nil {
+		panic(err)
+	}
+
+	masked := make([]byte, maskLen)
+	for i := range digest {
+		masked[i] = digest[i] ^ pad[i]
+	}
+
+	return base64.URLEncoding.EncodeToString(append(pad, masked...))
+}
+
+// unmaskToken reverses maskToken, returning the recovered SHA-256 digest.
+func unmaskToken(masked string) ([]byte, bool) {
+	raw, err := base64.URLEncoding.DecodeString(masked)
+	if err != nil || len(raw) != maskLen*2 {
+		return nil, false
+	}
+
+	pad, xored := raw[:maskLen], raw[maskLen:]
+	real := make([]byte, maskLen)
+	for i := range real {
+		real[i] = pad[i] ^ xored[i]
+	}
+
+	return real, true
+}
+
+const defaultCookieName = "_csrf"
+
+// signCookieToken HMAC-signs value with secret and returns "value.signature",
+// where value is included as is and signature is base64-URL-encoded.
+func signCookieToken(secret, value string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, value)
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	return value + "." + sig
+}
+
+// verifyCookieToken checks the signature produced by signCookieToken and
+// returns the original value if it is intact. It splits on the last "." so
+// that a value containing dots - e.g. a CookieBind returning an email
+// address - isn't truncated; the base64-URL-encoded signature itself never
+// contains one.
+func verifyCookieToken(secret, signed string) (string, bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx < 0 {
+		return "", false
+	}
+
+	value := signed[:idx]
+	expected := signCookieToken(secret, value)
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signed)) != 1 {
+		return "", false
+	}
+
+	return value, true
+}
+
+// MiddlewareCookie validates CSRF tokens using the double-submit cookie
+// pattern: a signed, random token is stored in a cookie instead of the
+// session, so it works without gin-contrib/sessions. Use CookieToken, not
+// GetToken, to read the token back out for rendering.
+func MiddlewareCookie(options Options) gin.HandlerFunc {
+	ignoreMethods := options.IgnoreMethods
+	errorFunc := options.ErrorFunc
+	tokenGetter := buildTokenGetter(options)
+
+	if ignoreMethods == nil {
+		ignoreMethods = defaultIgnoreMethods
+	}
+
+	if errorFunc == nil {
+		errorFunc = defaultErrorFunc
+	}
+
+	cookieName := options.CookieName
+	if cookieName == "" {
+		cookieName = defaultCookieName
+	}
+
+	return func(c *gin.Context) {
+		c.Set(csrfSecret, options.Secret)
+
+		if len(options.IgnorePaths) > 0 {
+			for _, p := range options.IgnorePaths {
+				if strings.Contains(c.FullPath(), p) {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		bind := ""
+		if options.CookieBind != nil {
+			bind = options.CookieBind(c)
+		}
+
+		// A missing cookie, a bad signature, and a stale bind (e.g. an
+		// anonymous visitor's cookie after they log in and CookieBind starts
+		// returning their user ID) are all "no valid cookie yet" - reissue a
+		// fresh one rather than hard-rejecting the request.
+		cookie, err := c.Cookie(cookieName)
+		if nonce, ok := verifyCookieToken(options.Secret, cookie); err != nil || !ok || !strings.HasSuffix(nonce, "|"+bind) {
+			cookie = signCookieToken(options.Secret, uniuri.New()+"|"+bind)
+			setCSRFCookie(c, options, cookieName, cookie)
+		}
+
+		c.Set(csrfToken, cookie)
+
+		if inArray(ignoreMethods, c.Request.Method) {
+			c.Next()
+			return
+		}
+
+		if options.CheckOrigin || options.SameOriginOnly {
+			if !verifyOrigin(c, options) {
+				setFailure(c, &Error{Reason: ReasonBadOrigin})
+				errorFunc(c)
+				return
+			}
+		}
+
+		token := tokenGetter(c)
+
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(cookie)) != 1 {
+			setFailure(c, &Error{Reason: ReasonBadToken})
+			errorFunc(c)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// setCSRFCookie writes the signed CSRF cookie using the Cookie* fields of options.
+func setCSRFCookie(c *gin.Context, options Options, name, value string) {
+	if options.CookieSameSite != 0 {
+		c.SetSameSite(options.CookieSameSite)
+	}
+
+	maxAge := 0
+	if options.CookieExpires > 0 {
+		maxAge = int(options.CookieExpires.Seconds())
+	}
+
+	c.SetCookie(name, value, maxAge, options.CookiePath, options.CookieDomain, options.CookieSecure, options.CookieHTTPOnly)
+}
+
+// RefreshToken rotates the session's CSRF salt and returns the masked old
+// and new tokens, matching what GetToken would hand a template - so the
+// value returned here can be submitted straight back through Middleware
+// without any extra masking step. old is empty when no token was computed
+// earlier in the same request (e.g. by GetToken).
 func RefreshToken(c *gin.Context) (old, new string) {
 	session := sessions.Default(c)
 	secret := c.MustGet(csrfSecret).(string)
 
 	if t, ok := c.Get(csrfToken); ok {
-		old = t.(string)
+		old = maskToken(t.(string))
 	}
 
-	salt := uniuri.New()
-	session.Set(csrfSalt, salt)
-	session.Save()
+	salt := storeSalt(session)
 
-	new = tokenize(secret, salt)
-	c.Set(csrfToken, new)
+	raw := tokenize(secret, salt)
+	c.Set(csrfToken, raw)
+	new = maskToken(raw)
 
 	return
 }
@@ -0,0 +1,545 @@
+package csrf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+var errTestCause = errors.New("test cause")
+
+// newSessionRouter wires Middleware behind gin-contrib/sessions, exposing a
+// GET /form route that renders GetToken and a POST /submit route guarded by
+// the middleware, so tests can exercise a full request/response round trip.
+func newSessionRouter(options Options) *gin.Engine {
+	r := gin.New()
+	r.Use(sessions.Sessions("gin-csrf-test", cookie.NewStore([]byte("test-session-secret"))))
+	r.Use(Middleware(options))
+
+	r.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, GetToken(c))
+	})
+	r.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	return r
+}
+
+// getForm issues a GET /form and returns the rendered token plus the
+// session cookie the server set in response.
+func getForm(t *testing.T, r *gin.Engine) (token string, sessionCookie *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /form: expected 200, got %d", w.Code)
+	}
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gin-csrf-test" {
+			sessionCookie = c
+		}
+	}
+
+	if sessionCookie == nil {
+		t.Fatal("GET /form: no session cookie set")
+	}
+
+	return w.Body.String(), sessionCookie
+}
+
+// postSubmit posts token as the _csrf form field, carrying sessionCookie.
+func postSubmit(t *testing.T, r *gin.Engine, token string, sessionCookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := url.Values{"_csrf": {token}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(sessionCookie)
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestMaskTokenRoundTrip(t *testing.T) {
+	const token = "some-raw-token"
+
+	maskedA := maskToken(token)
+	maskedB := maskToken(token)
+
+	if maskedA == maskedB {
+		t.Fatal("maskToken should return a fresh ciphertext on every call")
+	}
+
+	expected := sha256.Sum256([]byte(token))
+
+	for _, masked := range []string{maskedA, maskedB} {
+		real, ok := unmaskToken(masked)
+		if !ok {
+			t.Fatalf("unmaskToken(%q) failed", masked)
+		}
+
+		if !bytes.Equal(real, expected[:]) {
+			t.Fatalf("unmaskToken(%q) = %x, want %x", masked, real, expected)
+		}
+	}
+}
+
+func TestUnmaskTokenRejectsGarbage(t *testing.T) {
+	if _, ok := unmaskToken("not-valid-base64!!"); ok {
+		t.Fatal("expected malformed input to be rejected")
+	}
+
+	if _, ok := unmaskToken(""); ok {
+		t.Fatal("expected empty input to be rejected")
+	}
+}
+
+func TestMiddlewareTokenRoundTrip(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret"})
+
+	token, sessionCookie := getForm(t, r)
+	w := postSubmit(t, r, token, sessionCookie)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /submit with a freshly rendered token: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMiddlewareRejectsTamperedToken(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret"})
+
+	token, sessionCookie := getForm(t, r)
+	w := postSubmit(t, r, token+"tampered", sessionCookie)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST /submit with a tampered token: expected 403, got %d", w.Code)
+	}
+}
+
+func TestBuildTokenGetterPrefersTokenLookupOverTokenGetter(t *testing.T) {
+	options := Options{
+		TokenLookup: "header:X-CSRF-Token,query:_csrf",
+		TokenGetter: func(c *gin.Context) string { return "from-token-getter" },
+	}
+	getter := buildTokenGetter(options)
+
+	req := httptest.NewRequest(http.MethodPost, "/?_csrf=from-query", nil)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	if got := getter(c); got != "from-query" {
+		t.Fatalf("expected TokenLookup to take precedence over TokenGetter, got %q", got)
+	}
+}
+
+func TestParseTokenLookupTriesSourcesInOrder(t *testing.T) {
+	getter := buildTokenGetter(Options{TokenLookup: "header:X-CSRF-Token,query:_csrf,form:_csrf"})
+
+	req := httptest.NewRequest(http.MethodPost, "/?_csrf=from-query", strings.NewReader("_csrf=from-form"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", "from-header")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	if got := getter(c); got != "from-header" {
+		t.Fatalf("expected header source to win, got %q", got)
+	}
+
+	// Drop the header: the next source in the list (query) should win.
+	req.Header.Del("X-CSRF-Token")
+	if got := getter(c); got != "from-query" {
+		t.Fatalf("expected query source to win once header is absent, got %q", got)
+	}
+}
+
+func TestParseTokenLookupSkipsMalformedEntries(t *testing.T) {
+	extractors := parseTokenLookup("bogus-entry,header:X-CSRF-Token")
+	if len(extractors) != 1 {
+		t.Fatalf("expected malformed entries to be skipped, got %d extractors", len(extractors))
+	}
+}
+
+func newOriginRequest(t *testing.T, origin string) *gin.Context {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/submit", nil)
+	req.Host = "example.com"
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	return c
+}
+
+func TestVerifyOriginSameOrigin(t *testing.T) {
+	c := newOriginRequest(t, "http://example.com")
+	if !verifyOrigin(c, Options{CheckOrigin: true}) {
+		t.Fatal("expected same-origin request to pass")
+	}
+}
+
+func TestVerifyOriginRejectsCrossOrigin(t *testing.T) {
+	c := newOriginRequest(t, "http://evil.com")
+	if verifyOrigin(c, Options{CheckOrigin: true}) {
+		t.Fatal("expected cross-origin request to be rejected")
+	}
+}
+
+func TestVerifyOriginRejectsMissingOrigin(t *testing.T) {
+	c := newOriginRequest(t, "")
+	if verifyOrigin(c, Options{CheckOrigin: true}) {
+		t.Fatal("expected a request with no Origin/Referer to be rejected")
+	}
+}
+
+func TestVerifyOriginTrustedOrigins(t *testing.T) {
+	c := newOriginRequest(t, "http://trusted.example.com")
+	if !verifyOrigin(c, Options{CheckOrigin: true, TrustedOrigins: []string{"trusted.example.com"}}) {
+		t.Fatal("expected a trusted origin to pass")
+	}
+}
+
+func TestVerifyOriginSameOriginOnlyIgnoresTrustedOrigins(t *testing.T) {
+	c := newOriginRequest(t, "http://trusted.example.com")
+	if verifyOrigin(c, Options{SameOriginOnly: true, TrustedOrigins: []string{"trusted.example.com"}}) {
+		t.Fatal("expected SameOriginOnly to ignore TrustedOrigins")
+	}
+}
+
+func TestMiddlewareRejectsCrossOriginRequest(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret", CheckOrigin: true})
+
+	token, sessionCookie := getForm(t, r)
+
+	body := url.Values{"_csrf": {token}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.com")
+	req.AddCookie(sessionCookie)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST /submit with a foreign Origin: expected 403, got %d", w.Code)
+	}
+}
+
+func TestErrorUnwrapsAndFormats(t *testing.T) {
+	wrapped := &Error{Reason: ReasonBadOrigin}
+	if got, want := wrapped.Error(), "csrf: bad origin"; got != want {
+		t.Fatalf("Error() = %q, want %q", got, want)
+	}
+
+	cause := errTestCause
+	withCause := &Error{Reason: ReasonBadToken, Err: cause}
+	if got, want := withCause.Error(), "csrf: bad token: test cause"; got != want {
+		t.Fatalf("Error() = %q, want %q", got, want)
+	}
+
+	if got := withCause.Unwrap(); got != cause {
+		t.Fatalf("Unwrap() = %v, want %v", got, cause)
+	}
+}
+
+func TestFailureReasonReportsTypedErrorOnRejection(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret"})
+
+	token, sessionCookie := getForm(t, r)
+	w := postSubmit(t, r, token+"tampered", sessionCookie)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), ReasonBadToken.String()) {
+		t.Fatalf("expected default error response to surface the failure reason, got %q", w.Body.String())
+	}
+
+	var recorded error
+	r = newSessionRouter(Options{Secret: "secret", ErrorFunc: func(c *gin.Context) {
+		recorded = FailureReason(c)
+		c.AbortWithStatus(http.StatusForbidden)
+	}})
+
+	token, sessionCookie = getForm(t, r)
+	postSubmit(t, r, token+"tampered", sessionCookie)
+
+	var csrfErr *Error
+	if !errors.As(recorded, &csrfErr) || csrfErr.Reason != ReasonBadToken {
+		t.Fatalf("expected FailureReason to return an *Error with ReasonBadToken, got %v", recorded)
+	}
+}
+
+func TestFailureReasonNilWhenNotSet(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	if err := FailureReason(c); err != nil {
+		t.Fatalf("expected nil when nothing was recorded, got %v", err)
+	}
+}
+
+func TestMiddlewareTokenLifetimeExpiry(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret", TokenLifetime: time.Millisecond})
+
+	token, sessionCookie := getForm(t, r)
+	time.Sleep(5 * time.Millisecond)
+
+	w := postSubmit(t, r, token, sessionCookie)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST /submit with an expired token: expected 403, got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), ReasonExpiredToken.String()) {
+		t.Fatalf("expected expiry to be reported as the failure reason, got %q", w.Body.String())
+	}
+}
+
+func TestMiddlewareTokenLifetimeZeroNeverExpires(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret"})
+
+	token, sessionCookie := getForm(t, r)
+	time.Sleep(5 * time.Millisecond)
+
+	w := postSubmit(t, r, token, sessionCookie)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the default (infinite) lifetime not to expire a fresh token, got %d", w.Code)
+	}
+}
+
+func TestRefreshTokenReturnsTokenAcceptedByMiddleware(t *testing.T) {
+	r := gin.New()
+	r.Use(sessions.Sessions("gin-csrf-test", cookie.NewStore([]byte("test-session-secret"))))
+	r.Use(Middleware(Options{Secret: "secret"}))
+
+	r.GET("/refresh", func(c *gin.Context) {
+		_, new := RefreshToken(c)
+		c.String(http.StatusOK, new)
+	})
+	r.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/refresh", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /refresh: expected 200, got %d", w.Code)
+	}
+
+	var sessionCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gin-csrf-test" {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("GET /refresh: no session cookie set")
+	}
+
+	submit := postSubmit(t, r, w.Body.String(), sessionCookie)
+	if submit.Code != http.StatusOK {
+		t.Fatalf("POST /submit with RefreshToken's new value: expected 200, got %d: %s", submit.Code, submit.Body.String())
+	}
+}
+
+func TestMiddlewareRotateOnUse(t *testing.T) {
+	r := newSessionRouter(Options{Secret: "secret", RotateOnUse: true})
+
+	token, sessionCookie := getForm(t, r)
+
+	first := postSubmit(t, r, token, sessionCookie)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first POST /submit: expected 200, got %d", first.Code)
+	}
+
+	var rotatedCookie *http.Cookie
+	for _, c := range first.Result().Cookies() {
+		if c.Name == "gin-csrf-test" {
+			rotatedCookie = c
+		}
+	}
+
+	if rotatedCookie == nil {
+		t.Fatal("expected RotateOnUse to issue a new session cookie after a successful submit")
+	}
+
+	// Replaying the same (now-rotated-away) token against the new session
+	// cookie must fail.
+	second := postSubmit(t, r, token, rotatedCookie)
+	if second.Code != http.StatusForbidden {
+		t.Fatalf("replaying the pre-rotation token: expected 403, got %d", second.Code)
+	}
+}
+
+// newCookieModeRouter wires MiddlewareCookie with an optional per-request
+// bind, exposing the same GET /form, POST /submit shape as the session-mode
+// router but backed by the double-submit cookie instead of a session.
+func newCookieModeRouter(bind func(c *gin.Context) string) *gin.Engine {
+	r := gin.New()
+	r.Use(MiddlewareCookie(Options{Secret: "secret", CookieBind: bind}))
+
+	r.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, CookieToken(c))
+	})
+	r.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	return r
+}
+
+func getCookieForm(t *testing.T, r *gin.Engine) (token string, csrfCookie *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /form: expected 200, got %d", w.Code)
+	}
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == defaultCookieName {
+			csrfCookie = c
+		}
+	}
+
+	if csrfCookie == nil {
+		t.Fatal("GET /form: no csrf cookie set")
+	}
+
+	return w.Body.String(), csrfCookie
+}
+
+func postCookieSubmit(t *testing.T, r *gin.Engine, token string, csrfCookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := url.Values{"_csrf": {token}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(csrfCookie)
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestMiddlewareCookieTokenRoundTrip(t *testing.T) {
+	r := newCookieModeRouter(nil)
+
+	token, csrfCookie := getCookieForm(t, r)
+	w := postCookieSubmit(t, r, token, csrfCookie)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /submit with a freshly rendered cookie token: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMiddlewareCookieReissuesOnBindChangeInsteadOfLockingOut(t *testing.T) {
+	loggedIn := false
+	r := newCookieModeRouter(func(c *gin.Context) string {
+		if loggedIn {
+			return "user-42"
+		}
+		return ""
+	})
+
+	// Anonymous visit: cookie is bound to "".
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("anonymous GET /form: expected 200, got %d", w.Code)
+	}
+
+	var anonCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == defaultCookieName {
+			anonCookie = c
+		}
+	}
+	if anonCookie == nil {
+		t.Fatal("anonymous GET /form: no csrf cookie set")
+	}
+
+	// The user logs in; CookieBind now returns a different value. The same
+	// GET request, carrying the stale cookie, must still succeed (and get a
+	// fresh cookie) rather than 403 the user out of the entire site.
+	loggedIn = true
+
+	w2 := httptest.NewRecorder()
+	req2 := httptest.NewRequest(http.MethodGet, "/form", nil)
+	req2.AddCookie(anonCookie)
+	r.ServeHTTP(w2, req2)
+
+	if w2.Code != http.StatusOK {
+		t.Fatalf("GET /form with a stale bind after login: expected 200, got %d", w2.Code)
+	}
+
+	var reissued bool
+	for _, c := range w2.Result().Cookies() {
+		if c.Name == defaultCookieName {
+			reissued = true
+		}
+	}
+	if !reissued {
+		t.Fatal("expected a fresh cookie to be reissued once the bind no longer matches")
+	}
+}
+
+func TestVerifyCookieTokenAllowsDotsInValue(t *testing.T) {
+	signed := signCookieToken("secret", "nonce|user@example.com")
+
+	value, ok := verifyCookieToken("secret", signed)
+	if !ok {
+		t.Fatal("expected a value containing dots to verify successfully")
+	}
+	if value != "nonce|user@example.com" {
+		t.Fatalf("expected recovered value %q, got %q", "nonce|user@example.com", value)
+	}
+}
+
+func TestMiddlewareCookieBindWithDottedValue(t *testing.T) {
+	r := newCookieModeRouter(func(c *gin.Context) string {
+		return "user@example.com"
+	})
+
+	token, csrfCookie := getCookieForm(t, r)
+	w := postCookieSubmit(t, r, token, csrfCookie)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /submit with a dotted CookieBind value: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}